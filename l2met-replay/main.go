@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"l2met/store"
+	"net/http"
+)
+
+var (
+	libratoUrl = "https://metrics-api.librato.com/v1/metrics"
+	limit      = flag.Int("limit", 100, "Number of dead letters to replay per run.")
+)
+
+// l2met-replay re-posts batches that the librato outlet gave up on after
+// exhausting its retry policy. Run it on a cron once the underlying
+// outage is resolved.
+func main() {
+	flag.Parse()
+
+	letters, err := store.ScanDeadLetters(*limit)
+	if err != nil {
+		fmt.Printf("at=%q error=%s\n", "scan-dead-letters-error", err)
+		return
+	}
+
+	for _, d := range letters {
+		if err := replay(d); err != nil {
+			fmt.Printf("at=%q id=%d token=%s error=%s\n", "replay-error", d.Id, d.Token, err)
+			continue
+		}
+		fmt.Printf("at=%q id=%d token=%s\n", "replayed", d.Id, d.Token)
+	}
+}
+
+func replay(d *store.DeadLetter) error {
+	token := store.Token{Id: d.Token}
+	if err := token.Get(); err != nil {
+		return err
+	}
+
+	url := d.Url
+	if len(url) == 0 {
+		// Dead letters saved before Url was tracked; they all predate
+		// the tagged schema, so the legacy endpoint is the right guess.
+		url = libratoUrl
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.SetBasicAuth(token.User, token.Pass)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status=%d", resp.StatusCode)
+	}
+	return d.Delete()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Retrier decides whether a failed post() attempt should be retried, how
+// long to wait before the next attempt, and whether a token has failed
+// enough in a row that we should stop hammering Librato on its behalf.
+type Retrier interface {
+	// Retryable reports whether this response/error is worth retrying.
+	// 4xx responses other than 429 are terminal: retrying won't fix a
+	// malformed request or bad auth.
+	Retryable(resp *http.Response, err error) bool
+	// NextDelay returns how long to sleep before attempt N+1.
+	NextDelay(attempt int) time.Duration
+	// Allow reports whether a token's circuit is closed (or half-open
+	// for a probe) and therefore safe to try.
+	Allow(token string) bool
+	// RecordResult updates the token's circuit state after an attempt.
+	RecordResult(token string, success bool)
+}
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+type breaker struct {
+	state               int
+	consecutiveFailures int
+	openedAt            time.Time
+}
+
+// backoffRetrier is the default Retrier: exponential backoff with
+// jitter between attempts, plus a per-token circuit breaker so one
+// token stuck failing doesn't burn every retry slot in the shared
+// worker pool.
+type backoffRetrier struct {
+	base, cap, jitter time.Duration
+	maxFailures       int
+	cooldown          time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+func newBackoffRetrier() *backoffRetrier {
+	return &backoffRetrier{
+		base:        100 * time.Millisecond,
+		cap:         30 * time.Second,
+		jitter:      250 * time.Millisecond,
+		maxFailures: 10,
+		cooldown:    30 * time.Second,
+		breakers:    make(map[string]*breaker),
+	}
+}
+
+func (r *backoffRetrier) Retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode == 429 {
+		return true
+	}
+	return resp.StatusCode/100 == 5
+}
+
+func (r *backoffRetrier) NextDelay(attempt int) time.Duration {
+	d := r.base * time.Duration(1<<uint(attempt))
+	if d > r.cap {
+		d = r.cap
+	}
+	return d + time.Duration(rand.Int63n(int64(r.jitter)))
+}
+
+func (r *backoffRetrier) Allow(token string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.breakerFor(token)
+	if b.state == breakerOpen && time.Since(b.openedAt) > r.cooldown {
+		b.state = breakerHalfOpen
+	}
+	return b.state != breakerOpen
+}
+
+func (r *backoffRetrier) RecordResult(token string, success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.breakerFor(token)
+	if success {
+		b.state = breakerClosed
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == breakerHalfOpen || b.consecutiveFailures >= r.maxFailures {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// breakerFor must be called with r.mu held.
+func (r *backoffRetrier) breakerFor(token string) *breaker {
+	b, ok := r.breakers[token]
+	if !ok {
+		b = &breaker{}
+		r.breakers[token] = b
+	}
+	return b
+}
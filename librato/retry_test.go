@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoffRetrierRetryable(t *testing.T) {
+	r := newBackoffRetrier()
+
+	cases := []struct {
+		name string
+		resp *http.Response
+		err  error
+		want bool
+	}{
+		{"network error", nil, errTest, true},
+		{"429 too many requests", &http.Response{StatusCode: 429}, nil, true},
+		{"500 server error", &http.Response{StatusCode: 500}, nil, true},
+		{"503 server error", &http.Response{StatusCode: 503}, nil, true},
+		{"400 bad request", &http.Response{StatusCode: 400}, nil, false},
+		{"401 unauthorized", &http.Response{StatusCode: 401}, nil, false},
+		{"200 ok", &http.Response{StatusCode: 200}, nil, false},
+	}
+	for _, c := range cases {
+		if got := r.Retryable(c.resp, c.err); got != c.want {
+			t.Errorf("%s: Retryable() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBackoffRetrierBreakerOpensAfterMaxFailures(t *testing.T) {
+	r := newBackoffRetrier()
+	token := "tok-1"
+
+	for i := 0; i < r.maxFailures; i++ {
+		if !r.Allow(token) {
+			t.Fatalf("Allow() = false before breaker should have opened (failure %d)", i)
+		}
+		r.RecordResult(token, false)
+	}
+
+	if r.Allow(token) {
+		t.Fatal("Allow() = true, want false once the breaker has opened")
+	}
+}
+
+func TestBackoffRetrierBreakerHalfOpensAfterCooldown(t *testing.T) {
+	r := newBackoffRetrier()
+	r.cooldown = 50 * time.Millisecond
+	token := "tok-2"
+
+	for i := 0; i < r.maxFailures; i++ {
+		r.Allow(token)
+		r.RecordResult(token, false)
+	}
+	if r.Allow(token) {
+		t.Fatal("Allow() = true, want false immediately after opening")
+	}
+
+	time.Sleep(2 * r.cooldown)
+	if !r.Allow(token) {
+		t.Fatal("Allow() = false, want true once cooldown has elapsed (half-open probe)")
+	}
+
+	b := r.breakerFor(token)
+	if b.state != breakerHalfOpen {
+		t.Fatalf("state = %d, want breakerHalfOpen", b.state)
+	}
+}
+
+func TestBackoffRetrierHalfOpenProbeFailureReopens(t *testing.T) {
+	r := newBackoffRetrier()
+	r.cooldown = 50 * time.Millisecond
+	token := "tok-3"
+
+	for i := 0; i < r.maxFailures; i++ {
+		r.Allow(token)
+		r.RecordResult(token, false)
+	}
+	time.Sleep(2 * r.cooldown)
+	r.Allow(token) // transitions to half-open
+
+	r.RecordResult(token, false)
+	if r.Allow(token) {
+		t.Fatal("Allow() = true, want false: a failed half-open probe should reopen the breaker")
+	}
+}
+
+func TestBackoffRetrierSuccessClosesBreaker(t *testing.T) {
+	r := newBackoffRetrier()
+	r.cooldown = 0
+	token := "tok-4"
+
+	for i := 0; i < r.maxFailures; i++ {
+		r.Allow(token)
+		r.RecordResult(token, false)
+	}
+	r.Allow(token) // transitions to half-open
+	r.RecordResult(token, true)
+
+	b := r.breakerFor(token)
+	if b.state != breakerClosed {
+		t.Fatalf("state = %d, want breakerClosed", b.state)
+	}
+	if b.consecutiveFailures != 0 {
+		t.Fatalf("consecutiveFailures = %d, want 0", b.consecutiveFailures)
+	}
+	if !r.Allow(token) {
+		t.Fatal("Allow() = false, want true once the breaker has closed")
+	}
+}
+
+type testErr struct{}
+
+func (testErr) Error() string { return "network error" }
+
+var errTest = testErr{}
@@ -0,0 +1,56 @@
+// Package outlet holds the bucket fetch/scan loop shared by every
+// outlet binary (librato, prometheus, ...), so the only thing that
+// differs between them is how a filled-in bucket gets converted and
+// shipped.
+package outlet
+
+import (
+	"fmt"
+	"l2met/store"
+	"l2met/utils"
+	"time"
+)
+
+// Coordinator is the live partition view an outlet's etcd coordinator
+// provides; partition.Coordinator satisfies this.
+type Coordinator interface {
+	PartitionId() int
+	MaxPartitions() int
+}
+
+// ScheduleFetch ticks once a second and kicks off Fetch every
+// processInterval seconds.
+func ScheduleFetch(processInterval int, coord Coordinator, metricPrefix string, inbox chan<- *store.Bucket) {
+	for t := range time.Tick(time.Second) {
+		if t.Second()%processInterval == 0 {
+			Fetch(t, coord, metricPrefix, inbox)
+		}
+	}
+}
+
+// Fetch finds the bucket ids for the minute ending at t that belong to
+// our partition and hands them off as empty Buckets to be filled in and
+// converted.
+func Fetch(t time.Time, coord Coordinator, metricPrefix string, inbox chan<- *store.Bucket) {
+	fmt.Printf("at=start_fetch minute=%d\n", t.Minute())
+	defer utils.MeasureT(time.Now(), metricPrefix+".fetch")
+	max := utils.RoundTime(t, time.Minute)
+	min := max.Add(-time.Minute)
+	for id := range ScanBuckets(min, max, coord, metricPrefix) {
+		inbox <- &store.Bucket{Id: id}
+	}
+}
+
+// ScanBuckets wraps store.ScanBucketIDs with the partition's current
+// view and a per-outlet measurement.
+func ScanBuckets(min, max time.Time, coord Coordinator, metricPrefix string) <-chan int64 {
+	out := make(chan int64)
+	go func() {
+		defer utils.MeasureT(time.Now(), metricPrefix+".scan-buckets")
+		defer close(out)
+		for id := range store.ScanBucketIDs(min, max, coord.MaxPartitions(), coord.PartitionId()) {
+			out <- id
+		}
+	}()
+	return out
+}
@@ -0,0 +1,166 @@
+// Package partition coordinates how a fleet of outlet processes divides
+// up the bucket table between themselves. Each process claims a slot
+// under a shared etcd prefix using a leased key; the set of live keys,
+// sorted, gives every process both its own index (partitionId) and the
+// current fleet size (maxPartitions). A dying process's lease expires
+// within one TTL, its key disappears, and everyone else rebalances
+// around the new, smaller fleet automatically.
+package partition
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+)
+
+// EndpointsFromEnv reads the comma-separated ETCD_ENDPOINTS env var so
+// an outlet's fleet can be pointed at a cluster without a code change.
+func EndpointsFromEnv() []string {
+	raw := os.Getenv("ETCD_ENDPOINTS")
+	if len(raw) == 0 {
+		return []string{"http://127.0.0.1:2379"}
+	}
+	return strings.Split(raw, ",")
+}
+
+// leaseTTL is how long a slot survives without renewal. concurrency.Session
+// renews the underlying etcd lease in the background for as long as the
+// session is open, so this only bounds how quickly a crashed process's
+// slot is reclaimed.
+const leaseTTL = 10
+
+// Coordinator tracks this process's partition assignment within a
+// named fleet. It is safe for concurrent use.
+type Coordinator struct {
+	mu            sync.RWMutex
+	partitionId   int
+	maxPartitions int
+
+	cli     *clientv3.Client
+	session *concurrency.Session
+	prefix  string
+	key     string
+}
+
+// New joins the fleet named by prefix (e.g. "/l2met/librato") and blocks
+// until this process has an initial partition assignment.
+func New(endpoints []string, prefix string) (*Coordinator, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := concurrency.NewSession(cli, concurrency.WithTTL(leaseTTL))
+	if err != nil {
+		cli.Close()
+		return nil, err
+	}
+
+	c := &Coordinator{
+		cli:     cli,
+		session: session,
+		prefix:  prefix,
+		key:     fmt.Sprintf("%s/members/%x", prefix, session.Lease()),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := cli.Put(ctx, c.key, "", clientv3.WithLease(session.Lease())); err != nil {
+		session.Close()
+		cli.Close()
+		return nil, err
+	}
+
+	if err := c.rebalance(); err != nil {
+		session.Close()
+		cli.Close()
+		return nil, err
+	}
+
+	go c.watch()
+	return c, nil
+}
+
+// PartitionId returns this process's current slot. It may change after
+// a rebalance, so callers should re-read it on every scan rather than
+// caching it.
+func (c *Coordinator) PartitionId() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.partitionId
+}
+
+// MaxPartitions returns the current fleet size.
+func (c *Coordinator) MaxPartitions() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.maxPartitions
+}
+
+// Close releases this process's slot immediately rather than waiting
+// for its lease to expire.
+func (c *Coordinator) Close() error {
+	c.session.Close()
+	return c.cli.Close()
+}
+
+// watch rebalances every time fleet membership changes.
+func (c *Coordinator) watch() {
+	wch := c.cli.Watch(context.Background(), c.prefix+"/members/", clientv3.WithPrefix())
+	for range wch {
+		if err := c.rebalance(); err != nil {
+			fmt.Printf("at=%q error=%s\n", "rebalance-error", err)
+		}
+	}
+}
+
+func (c *Coordinator) rebalance() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.cli.Get(ctx, c.prefix+"/members/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	sort.Strings(keys)
+
+	found := false
+	id := 0
+	for i, k := range keys {
+		if k == c.key {
+			id = i
+			found = true
+			break
+		}
+	}
+	if !found {
+		// Our own key is missing from a watch event that fired between
+		// a lease renewal blip and the key reappearing. Keep the
+		// last-known-good assignment rather than defaulting to 0 and
+		// risking two processes sharing the same partition.
+		fmt.Printf("at=%q key=%s\n", "rebalance-missing-self", c.key)
+		return nil
+	}
+
+	c.mu.Lock()
+	c.partitionId = id
+	c.maxPartitions = len(keys)
+	c.mu.Unlock()
+
+	fmt.Printf("at=%q partition=%d max=%d\n", "rebalanced", id, len(keys))
+	return nil
+}
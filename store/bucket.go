@@ -0,0 +1,119 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Bucket is a single minute-window aggregation for one metric name on
+// one token. Min/Max/Median/P95/P99 are backed by a TDigest rather than
+// the raw value list, so Get() is O(delta) regardless of how many
+// values a receiver folded into the bucket over the minute.
+type Bucket struct {
+	Id     int64
+	Name   string
+	Token  string
+	Source string
+	Time   time.Time
+
+	digest *TDigest
+	last   float64
+	sum    float64
+}
+
+// Get loads the bucket's row, including its digest blob, from Postgres.
+func (b *Bucket) Get() error {
+	var blob []byte
+	var last, sum sql.NullFloat64
+
+	row := pg.QueryRow("select name, token, source, time, digest, last, sum from buckets where id = $1", b.Id)
+	if err := row.Scan(&b.Name, &b.Token, &b.Source, &b.Time, &blob, &last, &sum); err != nil {
+		return err
+	}
+	b.last = last.Float64
+	b.sum = sum.Float64
+
+	b.digest = NewTDigest(DefaultCompression)
+	if len(blob) > 0 {
+		if err := json.Unmarshal(blob, b.digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add folds a single measured value into the bucket's persisted row.
+// Concurrent receivers add to the same bucket all the time, so the
+// read-merge-write happens inside a transaction that holds the row lock
+// across both: whichever receiver gets there second sees the first
+// one's digest/last/sum rather than clobbering it.
+func (b *Bucket) Add(val float64) error {
+	tx, err := pg.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var blob []byte
+	var last, sum sql.NullFloat64
+	row := tx.QueryRow("select digest, last, sum from buckets where id = $1 for update", b.Id)
+	if err := row.Scan(&blob, &last, &sum); err != nil {
+		return err
+	}
+
+	digest := NewTDigest(DefaultCompression)
+	if len(blob) > 0 {
+		if err := json.Unmarshal(blob, digest); err != nil {
+			return err
+		}
+	}
+	digest.Add(val)
+
+	b.digest = digest
+	b.last = val
+	b.sum = sum.Float64 + val
+
+	newBlob, err := json.Marshal(b.digest)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("update buckets set digest = $1, last = $2, sum = $3 where id = $4",
+		newBlob, b.last, b.sum, b.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Quantile returns the estimated value at quantile q (0 <= q <= 1),
+// letting callers emit whatever percentiles they're configured for
+// (p50/p90/p95/p99/p999, ...) without adding a method per percentile.
+func (b *Bucket) Quantile(q float64) float64 {
+	if b.digest == nil {
+		return 0
+	}
+	return b.digest.Quantile(q)
+}
+
+func (b *Bucket) Last() float64 { return b.last }
+func (b *Bucket) Min() float64  { return b.Quantile(0) }
+func (b *Bucket) Max() float64  { return b.Quantile(1) }
+
+func (b *Bucket) Mean() float64 {
+	if b.digest == nil || b.digest.Count == 0 {
+		return 0
+	}
+	return b.sum / b.digest.Count
+}
+
+func (b *Bucket) Median() float64 { return b.Quantile(0.5) }
+func (b *Bucket) P95() float64    { return b.Quantile(0.95) }
+func (b *Bucket) P99() float64    { return b.Quantile(0.99) }
+func (b *Bucket) Sum() float64    { return b.sum }
+
+func (b *Bucket) Count() int {
+	if b.digest == nil {
+		return 0
+	}
+	return int(b.digest.Count)
+}
@@ -0,0 +1,53 @@
+package store
+
+import "time"
+
+// DeadLetter holds a batch that an outlet gave up posting after
+// exhausting its retry policy, so it can be inspected or replayed later
+// instead of being dropped on the floor. Url is the exact endpoint the
+// outlet was posting to when it gave up, so replay hits the same schema
+// (legacy /v1/metrics or tagged /v1/measurements) the payload was built
+// for rather than guessing from the token's current Tagged setting.
+type DeadLetter struct {
+	Id      int64
+	Token   string
+	Url     string
+	Payload []byte
+	Time    time.Time
+}
+
+// SaveDeadLetter persists a terminally-failed batch for a token. payload
+// is whatever body the outlet was posting (already marshaled), stored
+// as-is so replay doesn't need to know how to rebuild it. url is the
+// endpoint that payload was built for.
+func SaveDeadLetter(token, url string, payload []byte) error {
+	_, err := pg.Exec("insert into dead_letters (token, url, payload, time) values ($1, $2, $3, now())",
+		token, url, payload)
+	return err
+}
+
+// ScanDeadLetters returns the oldest dead letters, up to limit, for a
+// replay command to work through.
+func ScanDeadLetters(limit int) ([]*DeadLetter, error) {
+	rows, err := pg.Query("select id, token, url, payload, time from dead_letters order by time asc limit $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []*DeadLetter
+	for rows.Next() {
+		d := new(DeadLetter)
+		if err := rows.Scan(&d.Id, &d.Token, &d.Url, &d.Payload, &d.Time); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// Delete removes a dead letter once it has been successfully replayed.
+func (d *DeadLetter) Delete() error {
+	_, err := pg.Exec("delete from dead_letters where id = $1", d.Id)
+	return err
+}
@@ -0,0 +1,166 @@
+package store
+
+import (
+	"math"
+	"sort"
+)
+
+// DefaultCompression bounds the number of centroids a TDigest keeps
+// (and therefore its memory footprint) independent of how many values
+// have been added to it.
+const DefaultCompression = 100
+
+// Centroid is a single (mean, weight) pair in a TDigest. Weight is the
+// count of raw values that have been folded into this centroid.
+type Centroid struct {
+	Mean   float64 `json:"mean"`
+	Weight float64 `json:"weight"`
+}
+
+// TDigest is a streaming quantile sketch. It keeps centroids sorted by
+// mean and merges new values into the nearest centroid as long as doing
+// so keeps that centroid's weight under the size bound for its quantile
+// position, so centroids near the median are coarse while centroids near
+// the tails stay fine-grained. Both insertion and quantile lookup run in
+// O(len(Centroids)), which is bounded by Compression regardless of how
+// many values have been added.
+type TDigest struct {
+	Compression float64    `json:"compression"`
+	Centroids   []Centroid `json:"centroids"`
+	Count       float64    `json:"count"`
+}
+
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = DefaultCompression
+	}
+	return &TDigest{Compression: compression}
+}
+
+// Add folds a single value into the digest.
+func (d *TDigest) Add(x float64) {
+	if len(d.Centroids) == 0 {
+		d.Centroids = append(d.Centroids, Centroid{Mean: x, Weight: 1})
+		d.Count = 1
+		return
+	}
+
+	idx, dist := d.nearest(x)
+	if dist == 0 || d.Centroids[idx].Weight+1 <= d.sizeBound(idx) {
+		c := &d.Centroids[idx]
+		c.Mean += (x - c.Mean) / (c.Weight + 1)
+		c.Weight++
+	} else {
+		d.Centroids = append(d.Centroids, Centroid{Mean: x, Weight: 1})
+		sort.Sort(byMean(d.Centroids))
+	}
+	d.Count++
+
+	if float64(len(d.Centroids)) > 2*d.Compression {
+		d.Compress()
+	}
+}
+
+// Merge folds another digest's centroids into this one. This is how two
+// receivers that both wrote into the same bucket get reconciled into a
+// single quantile estimate.
+func (d *TDigest) Merge(other *TDigest) {
+	if other == nil || len(other.Centroids) == 0 {
+		return
+	}
+	d.Centroids = append(d.Centroids, other.Centroids...)
+	d.Count += other.Count
+	sort.Sort(byMean(d.Centroids))
+	d.Compress()
+}
+
+// Quantile estimates the value at quantile q (0 <= q <= 1) by walking
+// centroids in order, accumulating weight until the target cumulative
+// weight is crossed, then interpolating between the straddling centroids.
+func (d *TDigest) Quantile(q float64) float64 {
+	if len(d.Centroids) == 0 {
+		return 0
+	}
+	if len(d.Centroids) == 1 {
+		return d.Centroids[0].Mean
+	}
+
+	target := q * d.Count
+	var cum float64
+	for i, c := range d.Centroids {
+		if cum+c.Weight >= target || i == len(d.Centroids)-1 {
+			if i == 0 {
+				return c.Mean
+			}
+			prev := d.Centroids[i-1]
+			frac := (target - cum) / c.Weight
+			return prev.Mean + frac*(c.Mean-prev.Mean)
+		}
+		cum += c.Weight
+	}
+	return d.Centroids[len(d.Centroids)-1].Mean
+}
+
+// Compress re-clusters centroids from scratch, merging adjacent ones
+// that still fit under the size bound for their quantile position. This
+// is what keeps len(Centroids) bounded after a Merge or a long run of Adds.
+func (d *TDigest) Compress() {
+	if len(d.Centroids) == 0 {
+		return
+	}
+	sort.Sort(byMean(d.Centroids))
+
+	merged := make([]Centroid, 0, len(d.Centroids))
+	cur := d.Centroids[0]
+	var cum float64
+	for _, c := range d.Centroids[1:] {
+		q := (cum + cur.Weight/2) / d.Count
+		bound := 4 * d.Count * q * (1 - q) / d.Compression
+		if cur.Weight+c.Weight <= bound {
+			cur.Mean = (cur.Mean*cur.Weight + c.Mean*c.Weight) / (cur.Weight + c.Weight)
+			cur.Weight += c.Weight
+		} else {
+			cum += cur.Weight
+			merged = append(merged, cur)
+			cur = c
+		}
+	}
+	d.Centroids = append(merged, cur)
+}
+
+// nearest returns the index of the centroid closest to x and the
+// distance to it.
+func (d *TDigest) nearest(x float64) (int, float64) {
+	best := 0
+	bestDist := math.Abs(d.Centroids[0].Mean - x)
+	for i := 1; i < len(d.Centroids); i++ {
+		dist := math.Abs(d.Centroids[i].Mean - x)
+		if dist < bestDist {
+			best = i
+			bestDist = dist
+		}
+	}
+	return best, bestDist
+}
+
+// sizeBound is the maximum weight centroid idx may carry without
+// violating the t-digest invariant, 4 * n * q * (1-q) / delta, where q
+// is the centroid's position in the overall quantile range.
+func (d *TDigest) sizeBound(idx int) float64 {
+	if d.Count == 0 {
+		return math.Inf(1)
+	}
+	var cum float64
+	for i := 0; i < idx; i++ {
+		cum += d.Centroids[i].Weight
+	}
+	cum += d.Centroids[idx].Weight / 2
+	q := cum / d.Count
+	return 4 * d.Count * q * (1 - q) / d.Compression
+}
+
+type byMean []Centroid
+
+func (b byMean) Len() int           { return len(b) }
+func (b byMean) Less(i, j int) bool { return b[i].Mean < b[j].Mean }
+func (b byMean) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
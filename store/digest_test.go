@@ -0,0 +1,49 @@
+package store
+
+import "testing"
+
+func TestTDigestQuantileUniform(t *testing.T) {
+	d := NewTDigest(DefaultCompression)
+	for i := 1; i <= 1000; i++ {
+		d.Add(float64(i))
+	}
+
+	cases := []struct {
+		q    float64
+		want float64
+		tol  float64
+	}{
+		{0, 1, 1},
+		{0.5, 500, 20},
+		{0.95, 950, 20},
+		{0.99, 990, 20},
+		{1, 1000, 1},
+	}
+	for _, c := range cases {
+		got := d.Quantile(c.q)
+		if got < c.want-c.tol || got > c.want+c.tol {
+			t.Errorf("Quantile(%v) = %v, want within %v of %v", c.q, got, c.tol, c.want)
+		}
+	}
+}
+
+func TestTDigestMerge(t *testing.T) {
+	a := NewTDigest(DefaultCompression)
+	for i := 1; i <= 500; i++ {
+		a.Add(float64(i))
+	}
+
+	b := NewTDigest(DefaultCompression)
+	for i := 501; i <= 1000; i++ {
+		b.Add(float64(i))
+	}
+
+	a.Merge(b)
+
+	if a.Count != 1000 {
+		t.Fatalf("Count = %v, want 1000", a.Count)
+	}
+	if got := a.Quantile(0.5); got < 480 || got > 520 {
+		t.Errorf("Quantile(0.5) after merge = %v, want near 500", got)
+	}
+}
@@ -0,0 +1,26 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	_ "github.com/lib/pq"
+)
+
+var pg *sql.DB
+
+func init() {
+	url := os.Getenv("DATABASE_URL")
+	if len(url) == 0 {
+		fmt.Println("Must set DATABASE_URL.")
+		os.Exit(1)
+	}
+
+	var err error
+	pg, err = sql.Open("postgres", url)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,30 @@
+package store
+
+import "time"
+
+// ScanBucketIDs returns the ids of buckets in [min, max) that belong to
+// partitionId out of maxPartitions, newest first. Both outlets (librato,
+// prometheus) scan off this same query so the partitioning scheme only
+// lives in one place.
+func ScanBucketIDs(min, max time.Time, maxPartitions, partitionId int) <-chan int64 {
+	c := make(chan int64)
+
+	go func(c chan<- int64) {
+		defer close(c)
+		s := "select id from buckets where time >= $1 and time < $2 "
+		s += "and MOD(id, $3) = $4 "
+		s += "order by time desc"
+		rows, err := pg.Query(s, min, max, maxPartitions, partitionId)
+		if err == nil {
+			defer rows.Close()
+			for rows.Next() {
+				var id int64
+				if err := rows.Scan(&id); err == nil {
+					c <- id
+				}
+			}
+		}
+	}(c)
+
+	return c
+}
@@ -0,0 +1,20 @@
+package store
+
+// Token represents the credentials a drain uses to authenticate with an
+// outlet (e.g. Librato's HTTP Basic Auth) and is keyed off the l2met
+// token id embedded in the drain URL.
+type Token struct {
+	Id   string
+	User string
+	Pass string
+
+	// Tagged opts this token into Librato's tagged /v1/measurements
+	// schema instead of the legacy source-based /v1/metrics schema, so
+	// drains can migrate one at a time.
+	Tagged bool
+}
+
+func (t *Token) Get() error {
+	row := pg.QueryRow(`select "user", pass, tagged from tokens where id = $1`, t.Id)
+	return row.Scan(&t.User, &t.Pass, &t.Tagged)
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// withJWTConfig sets the package-level JWT vars for the duration of a test
+// and restores them afterwards, since parseJWT reads process-wide config
+// rather than taking it as an argument.
+func withJWTConfig(t *testing.T, alg string, key []byte, rsaKey *rsa.PublicKey, claim string) {
+	t.Helper()
+	origAlg, origKey, origRSAKey, origClaim := jwtAlg, jwtKey, jwtRSAKey, jwtClaim
+	jwtAlg, jwtKey, jwtRSAKey, jwtClaim = alg, key, rsaKey, claim
+	t.Cleanup(func() {
+		jwtAlg, jwtKey, jwtRSAKey, jwtClaim = origAlg, origKey, origRSAKey, origClaim
+	})
+}
+
+func signHS256(t *testing.T, key []byte, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	s, err := tok.SignedString(key)
+	if err != nil {
+		t.Fatalf("sign HS256: %s", err)
+	}
+	return s
+}
+
+func TestParseJWTHS256(t *testing.T) {
+	key := []byte("super-secret")
+	withJWTConfig(t, "HS256", key, nil, "sub")
+
+	raw := signHS256(t, key, jwt.MapClaims{"sub": "token-123", "exp": time.Now().Add(time.Hour).Unix()})
+	sub, err := parseJWT(raw)
+	if err != nil {
+		t.Fatalf("parseJWT: %s", err)
+	}
+	if sub != "token-123" {
+		t.Errorf("sub = %q, want %q", sub, "token-123")
+	}
+}
+
+func TestParseJWTRS256(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	withJWTConfig(t, "RS256", nil, &priv.PublicKey, "sub")
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "token-456",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	raw, err := tok.SignedString(priv)
+	if err != nil {
+		t.Fatalf("sign RS256: %s", err)
+	}
+
+	sub, err := parseJWT(raw)
+	if err != nil {
+		t.Fatalf("parseJWT: %s", err)
+	}
+	if sub != "token-456" {
+		t.Errorf("sub = %q, want %q", sub, "token-456")
+	}
+}
+
+func TestParseJWTExpired(t *testing.T) {
+	key := []byte("super-secret")
+	withJWTConfig(t, "HS256", key, nil, "sub")
+
+	raw := signHS256(t, key, jwt.MapClaims{"sub": "token-123", "exp": time.Now().Add(-time.Hour).Unix()})
+	if _, err := parseJWT(raw); err != ErrExpired {
+		t.Errorf("err = %v, want ErrExpired", err)
+	}
+}
+
+func TestParseJWTNoKeyConfigured(t *testing.T) {
+	key := []byte("super-secret")
+	raw := signHS256(t, key, jwt.MapClaims{"sub": "token-123", "exp": time.Now().Add(time.Hour).Unix()})
+
+	withJWTConfig(t, "HS256", nil, nil, "sub")
+	if _, err := parseJWT(raw); err != ErrBadSignature {
+		t.Errorf("err = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestParseJWTNoRSAKeyConfigured(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "token-456",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	raw, err := tok.SignedString(priv)
+	if err != nil {
+		t.Fatalf("sign RS256: %s", err)
+	}
+
+	withJWTConfig(t, "RS256", nil, nil, "sub")
+	if _, err := parseJWT(raw); err != ErrBadSignature {
+		t.Errorf("err = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestParseJWTAlgMismatch(t *testing.T) {
+	// Server configured for HS256, but the token is signed RS256 - the
+	// keyfunc must reject it rather than accepting whatever alg the
+	// token claims (alg-confusion).
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "token-456",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	raw, err := tok.SignedString(priv)
+	if err != nil {
+		t.Fatalf("sign RS256: %s", err)
+	}
+
+	withJWTConfig(t, "HS256", []byte("super-secret"), nil, "sub")
+	if _, err := parseJWT(raw); err != ErrBadSignature {
+		t.Errorf("err = %v, want ErrBadSignature", err)
+	}
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// measureBuffer bounds how many pending measurements a burst of
+// MeasureI/MeasureT/... calls can queue up before the drain loop has a
+// chance to run. It's sized generously since a dropped sample is far
+// cheaper than a call site blocking on stdout.
+const measureBuffer = 10000
+
+// Kind is the shape of a measurement, so sinks that care (Prometheus)
+// can route it to the right metric type.
+type Kind int
+
+const (
+	KindGauge Kind = iota
+	KindCounter
+	KindHistogram
+	KindError
+)
+
+// Measurement is what a Measure* call produces. appName is prefixed
+// onto Name the same way the old synchronous implementation did, so
+// sinks don't each need to know about it.
+type Measurement struct {
+	Name  string
+	Kind  Kind
+	Val   float64
+	Err   error
+	Stamp time.Time
+}
+
+// Sink receives every measurement that flows through the buffer. It
+// runs on the single drain goroutine, so implementations don't need to
+// be safe for concurrent use by each other, only by themselves.
+type Sink interface {
+	HandleMeasurement(Measurement)
+}
+
+var (
+	measurements = make(chan Measurement, measureBuffer)
+	sinks        []Sink
+)
+
+func init() {
+	for _, name := range strings.Split(envOrDefault("MEASURE_SINKS", "stdout"), ",") {
+		switch strings.TrimSpace(name) {
+		case "stdout":
+			sinks = append(sinks, stdoutSink{})
+		case "prometheus":
+			sinks = append(sinks, newPrometheusSink())
+		case "librato":
+			sinks = append(sinks, newSelfLibratoSink())
+		}
+	}
+	go drain()
+}
+
+func envOrDefault(name, def string) string {
+	if v := os.Getenv(name); len(v) > 0 {
+		return v
+	}
+	return def
+}
+
+// drain is the only goroutine that hands measurements to sinks (enqueue
+// may also take one off the channel, but only to discard it), so sinks
+// never need their own locking to stay consistent with themselves.
+func drain() {
+	for m := range measurements {
+		for _, s := range sinks {
+			s.HandleMeasurement(m)
+		}
+	}
+}
+
+// enqueue is non-blocking: if the buffer is full we drop the oldest
+// pending measurement rather than stall the caller, since callers are
+// almost always on a hot path (a fetch/convert/post loop) that matters
+// more than any one sample.
+func enqueue(m Measurement) {
+	select {
+	case measurements <- m:
+		return
+	default:
+	}
+	select {
+	case <-measurements:
+	default:
+	}
+	select {
+	case measurements <- m:
+	default:
+	}
+}
+
+func MeasureI(n string, i int64) {
+	enqueue(Measurement{Name: appName + "." + n, Kind: KindGauge, Val: float64(i), Stamp: time.Now()})
+}
+
+func MeasureE(n string, e error) {
+	enqueue(Measurement{Name: appName + "." + n, Kind: KindError, Err: e, Stamp: time.Now()})
+}
+
+func MeasureT(t time.Time, n string) {
+	ms := float64(time.Since(t) / time.Millisecond)
+	enqueue(Measurement{Name: appName + "." + n, Kind: KindHistogram, Val: ms, Stamp: time.Now()})
+}
+
+// MeasureH records an arbitrary value as a histogram sample, e.g.
+// request sizes or queue depths where a single gauge sample would lose
+// the distribution.
+func MeasureH(n string, v float64) {
+	enqueue(Measurement{Name: appName + "." + n, Kind: KindHistogram, Val: v, Stamp: time.Now()})
+}
+
+// Measure is a bare counter increment for call sites that only care
+// "this happened", not any associated value.
+func Measure(n string) {
+	enqueue(Measurement{Name: appName + "." + n, Kind: KindCounter, Val: 1, Stamp: time.Now()})
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// selfLibratoSink ships l2met's own internal measurements through
+// Librato, using its own credentials (SELF_LIBRATO_USER/PASS) rather
+// than the per-drain token pipeline the librato outlet uses for user
+// metrics. It never calls back into Measure/MeasureI/... on its own
+// behalf: doing so would re-enter the buffer it's draining, so an
+// outage posting l2met's own metrics would end up reporting its own
+// inability to report the outage, forever.
+type selfLibratoSink struct {
+	user, pass string
+	url        string
+
+	mu    sync.Mutex
+	batch []*selfMeasurement
+}
+
+type selfMeasurement struct {
+	Name   string `json:"name"`
+	Val    string `json:"value"`
+	Time   int64  `json:"measure_time"`
+	Source string `json:"source,omitempty"`
+}
+
+func newSelfLibratoSink() *selfLibratoSink {
+	s := &selfLibratoSink{
+		user: os.Getenv("SELF_LIBRATO_USER"),
+		pass: os.Getenv("SELF_LIBRATO_PASS"),
+		url:  "https://metrics-api.librato.com/v1/metrics",
+	}
+	go s.flushLoop()
+	return s
+}
+
+func (s *selfLibratoSink) HandleMeasurement(m Measurement) {
+	if len(s.user) == 0 {
+		return
+	}
+	val := m.Val
+	if m.Kind == KindError {
+		val = 1
+	}
+
+	s.mu.Lock()
+	s.batch = append(s.batch, &selfMeasurement{
+		Name:   m.Name,
+		Val:    strconv.FormatFloat(val, 'f', 5, 64),
+		Time:   m.Stamp.Unix(),
+		Source: appName,
+	})
+	s.mu.Unlock()
+}
+
+func (s *selfLibratoSink) flushLoop() {
+	for range time.Tick(time.Minute) {
+		s.flush()
+	}
+}
+
+func (s *selfLibratoSink) flush() {
+	s.mu.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"gauges": batch})
+	if err != nil {
+		fmt.Printf("at=%q error=%s\n", "self-librato-marshal-error", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewBuffer(body))
+	if err != nil {
+		fmt.Printf("at=%q error=%s\n", "self-librato-request-error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(s.user, s.pass)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("at=%q error=%s\n", "self-librato-post-error", err)
+		return
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prometheusSink lets l2met's own telemetry be scraped instead of only
+// read off stdout. It owns its counters/gauges/histograms directly
+// since HandleMeasurement only ever runs on the single drain goroutine.
+type prometheusSink struct {
+	counters   map[string]prometheus.Counter
+	gauges     map[string]prometheus.Gauge
+	histograms map[string]prometheus.Histogram
+	registry   *prometheus.Registry
+}
+
+func newPrometheusSink() *prometheusSink {
+	s := &prometheusSink{
+		counters:   make(map[string]prometheus.Counter),
+		gauges:     make(map[string]prometheus.Gauge),
+		histograms: make(map[string]prometheus.Histogram),
+		registry:   prometheus.NewRegistry(),
+	}
+
+	addr := envOrDefault("MEASURE_PROMETHEUS_LISTEN", ":9000")
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("at=%q error=%s\n", "measure-listen-error", err)
+		}
+	}()
+
+	return s
+}
+
+func (s *prometheusSink) HandleMeasurement(m Measurement) {
+	name := SanitizeMetricName(m.Name)
+	switch m.Kind {
+	case KindCounter:
+		s.counter(name).Add(m.Val)
+	case KindHistogram:
+		s.histogram(name).Observe(m.Val)
+	case KindError:
+		s.counter(name + "_error_total").Inc()
+	default:
+		s.gauge(name).Set(m.Val)
+	}
+}
+
+func (s *prometheusSink) counter(name string) prometheus.Counter {
+	c, ok := s.counters[name]
+	if !ok {
+		c = prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: "l2met internal measurement"})
+		s.counters[name] = c
+		s.registry.MustRegister(c)
+	}
+	return c
+}
+
+func (s *prometheusSink) gauge(name string) prometheus.Gauge {
+	g, ok := s.gauges[name]
+	if !ok {
+		g = prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: "l2met internal measurement"})
+		s.gauges[name] = g
+		s.registry.MustRegister(g)
+	}
+	return g
+}
+
+func (s *prometheusSink) histogram(name string) prometheus.Histogram {
+	h, ok := s.histograms[name]
+	if !ok {
+		h = prometheus.NewHistogram(prometheus.HistogramOpts{Name: name, Help: "l2met internal measurement"})
+		s.histograms[name] = h
+		s.registry.MustRegister(h)
+	}
+	return h
+}
+
+// SanitizeMetricName swaps the dots and dashes l2met uses in measurement
+// names for underscores, which is all Prometheus metric names allow.
+// Shared by this sink and the standalone prometheus outlet so the two
+// don't drift on what counts as a legal name.
+func SanitizeMetricName(n string) string {
+	out := make([]byte, len(n))
+	for i := 0; i < len(n); i++ {
+		if n[i] == '.' || n[i] == '-' {
+			out[i] = '_'
+		} else {
+			out[i] = n[i]
+		}
+	}
+	return string(out)
+}
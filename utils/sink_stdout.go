@@ -0,0 +1,17 @@
+package utils
+
+import "fmt"
+
+// stdoutSink reproduces the logfmt lines the old synchronous
+// MeasureI/MeasureE/MeasureT printed directly, just emitted from the
+// drain loop instead of the call site.
+type stdoutSink struct{}
+
+func (stdoutSink) HandleMeasurement(m Measurement) {
+	switch m.Kind {
+	case KindError:
+		fmt.Printf("measure=%q error=%s\n", m.Name, m.Err)
+	default:
+		fmt.Printf("measure=%q val=%d\n", m.Name, int64(m.Val))
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -9,10 +10,30 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/golang-jwt/jwt/v4"
 )
 
 var (
 	appName string
+
+	// jwtAlg/jwtKey/jwtRSAKey configure how Bearer tokens are verified.
+	// JWT_SIGNING_ALG selects HS256 (the default, keyed by JWT_SIGNING_KEY
+	// as a raw secret) or RS256 (keyed by JWT_SIGNING_KEY as a PEM public
+	// key). JWT_CLAIM names the claim returned as the l2met token.
+	jwtAlg    string
+	jwtKey    []byte
+	jwtRSAKey *rsa.PublicKey
+	jwtClaim  string
+)
+
+// Errors returned by ParseToken so receivers can map them to the right
+// HTTP status instead of treating every failure as a generic 401.
+var (
+	ErrNoAuth       = errors.New("Authorization header not set.")
+	ErrMalformed    = errors.New("Malformed header.")
+	ErrExpired      = errors.New("Token expired.")
+	ErrBadSignature = errors.New("Bad token signature.")
 )
 
 func init() {
@@ -21,21 +42,30 @@ func init() {
 		fmt.Println("Must set APP_NAME.")
 		os.Exit(1)
 	}
-}
 
-func MeasureI(n string, i int64) {
-	n = appName + "." + n
-	fmt.Printf("measure=%q val=%d\n", n, i)
-}
-
-func MeasureE(n string, e error) {
-	n = appName + "." + n
-	fmt.Printf("measure=%q error=%s\n", n, e)
-}
+	jwtAlg = os.Getenv("JWT_SIGNING_ALG")
+	if len(jwtAlg) == 0 {
+		jwtAlg = "HS256"
+	}
+	jwtClaim = os.Getenv("JWT_CLAIM")
+	if len(jwtClaim) == 0 {
+		jwtClaim = "sub"
+	}
 
-func MeasureT(t time.Time, n string) {
-	n = appName + "." + n
-	fmt.Printf("measure=%q val=%d\n", n, time.Since(t)/time.Millisecond)
+	key := os.Getenv("JWT_SIGNING_KEY")
+	if len(key) == 0 {
+		return
+	}
+	if jwtAlg == "RS256" {
+		pub, err := jwt.ParseRSAPublicKeyFromPEM([]byte(key))
+		if err != nil {
+			fmt.Printf("at=%q error=%s\n", "jwt-signing-key-error", err)
+			os.Exit(1)
+		}
+		jwtRSAKey = pub
+	} else {
+		jwtKey = []byte(key)
+	}
 }
 
 func WriteJsonBytes(w http.ResponseWriter, status int, b []byte) {
@@ -59,26 +89,80 @@ func RoundTime(t time.Time, d time.Duration) time.Time {
 	return time.Unix(0, int64((time.Duration(t.UnixNano())/d)*d))
 }
 
+// ParseToken pulls the l2met token out of the request's Authorization
+// header, accepting either HTTP Basic (the password is the token, as
+// before) or a Bearer JWT (the configured claim, default "sub", is the
+// token). This lets operators front l2met with an identity provider
+// instead of provisioning per-drain basic-auth secrets.
 func ParseToken(r *http.Request) (string, error) {
 	header, ok := r.Header["Authorization"]
 	if !ok {
-		return "", errors.New("Authorization header not set.")
+		return "", ErrNoAuth
 	}
 
 	auth := strings.SplitN(header[0], " ", 2)
 	if len(auth) != 2 {
-		return "", errors.New("Malformed header.")
+		return "", ErrMalformed
 	}
 
-	userPass, err := base64.StdEncoding.DecodeString(auth[1])
+	switch auth[0] {
+	case "Bearer":
+		return parseJWT(auth[1])
+	case "Basic":
+		return parseBasicAuth(auth[1])
+	default:
+		return "", ErrMalformed
+	}
+}
+
+func parseBasicAuth(encoded string) (string, error) {
+	userPass, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return "", errors.New("Malformed encoding.")
+		return "", ErrMalformed
 	}
 
 	parts := strings.Split(string(userPass), ":")
 	if len(parts) != 2 {
-		return "", errors.New("Password not supplied.")
+		return "", ErrMalformed
 	}
 
 	return parts[1], nil
 }
+
+func parseJWT(raw string) (string, error) {
+	token, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		if jwtAlg == "RS256" {
+			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, ErrBadSignature
+			}
+			if jwtRSAKey == nil {
+				return nil, ErrBadSignature
+			}
+			return jwtRSAKey, nil
+		}
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, ErrBadSignature
+		}
+		if len(jwtKey) == 0 {
+			return nil, ErrBadSignature
+		}
+		return jwtKey, nil
+	})
+	if err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return "", ErrExpired
+		}
+		return "", ErrBadSignature
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return "", ErrBadSignature
+	}
+
+	sub, ok := claims[jwtClaim].(string)
+	if !ok {
+		return "", ErrBadSignature
+	}
+	return sub, nil
+}